@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// adminServer exposes a small loopback-by-default JSON API for inspecting
+// and managing a running instance without editing its config file or
+// restarting it: GET /status, GET /config, POST /reload, POST
+// /cache/flush, DELETE /cache/{key}, and POST /rescan?path=.... It is
+// opt-in via -adminHttp and authorizes callers against the union of every
+// root's AllowedIpNets, the same whitelists the dms servers themselves
+// check.
+type adminServer struct {
+	p        *program
+	listener net.Listener
+	srv      *http.Server
+}
+
+// newAdminServer starts listening on addr but does not yet accept
+// connections; call serve to do that. A bare port (e.g. ":1339") binds
+// loopback only rather than every interface.
+func newAdminServer(p *program, addr string) (*adminServer, error) {
+	l, err := net.Listen("tcp", loopbackIfBare(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &adminServer{p: p, listener: l}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", a.handleStatus)
+	mux.HandleFunc("GET /config", a.handleConfig)
+	mux.HandleFunc("POST /reload", a.handleReload)
+	mux.HandleFunc("POST /cache/flush", a.handleCacheFlush)
+	mux.HandleFunc("DELETE /cache/{key}", a.handleCacheDelete)
+	mux.HandleFunc("POST /rescan", a.handleRescan)
+
+	a.srv = &http.Server{Handler: a.authorize(mux)}
+	return a, nil
+}
+
+// loopbackIfBare rewrites an address with no host, such as ":1339", to
+// bind loopback instead of every interface.
+func loopbackIfBare(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// serve runs the admin API until close is called. It is meant to be run
+// in its own goroutine.
+func (a *adminServer) serve() {
+	if err := a.srv.Serve(a.listener); err != nil && err != http.ErrServerClosed {
+		log.Print(err)
+	}
+}
+
+func (a *adminServer) close() error {
+	return a.srv.Close()
+}
+
+// authorize rejects requests from clients not covered by any configured
+// root's AllowedIpNets, mirroring the check dms.Server itself applies.
+// The top-level AllowedIpNets field (and thus -allowedIps) only feeds the
+// single implicit root synthesized when Roots is unset, so it alone
+// isn't a reliable allowlist once multi-root config is in use: a client
+// permitted to browse or stream via any one root may also reach the
+// admin API.
+func (a *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+
+		a.p.mu.Lock()
+		nets := aggregateAllowedIpNets(a.p.roots)
+		a.p.mu.Unlock()
+
+		if ip == nil || !ipAllowed(ip, nets) {
+			log.Printf("admin API: rejected client %s", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// aggregateAllowedIpNets unions every root's AllowedIpNets.
+func aggregateAllowedIpNets(roots []RootConfig) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, root := range roots {
+		nets = append(nets, root.AllowedIpNets...)
+	}
+	return nets
+}
+
+func ipAllowed(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+type statusResponse struct {
+	StartedAt  time.Time `json:"startedAt"`
+	Uptime     string    `json:"uptime"`
+	Interfaces []string  `json:"interfaces"`
+	Roots      int       `json:"roots"`
+	// Subscribers is always -1: the vendored dms.Server keeps its UPnP
+	// event subscribers in an unexported field with no accessor, so this
+	// can't be reported without forking it.
+	Subscribers int                `json:"subscribers"`
+	Cache       cacheStatsResponse `json:"cache"`
+}
+
+type cacheStatsResponse struct {
+	Entries   int   `json:"entries"`
+	SizeBytes int64 `json:"sizeBytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+}
+
+func (a *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	a.p.mu.Lock()
+	ifNames := make([]string, len(a.p.interfaces))
+	for i, iface := range a.p.interfaces {
+		ifNames[i] = iface.Name
+	}
+	roots := len(a.p.roots)
+	a.p.mu.Unlock()
+
+	stats, err := a.p.cache.stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, statusResponse{
+		StartedAt:   a.p.startedAt,
+		Uptime:      time.Since(a.p.startedAt).String(),
+		Interfaces:  ifNames,
+		Roots:       roots,
+		Subscribers: -1,
+		Cache: cacheStatsResponse{
+			Entries:   stats.Entries,
+			SizeBytes: stats.SizeBytes,
+			Hits:      stats.Hits,
+			Misses:    stats.Misses,
+		},
+	})
+}
+
+func (a *adminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	// config is mutated in place by reloadConfig under p.mu, so it must be
+	// copied under the same lock rather than read directly here.
+	a.p.mu.Lock()
+	cfg := *config
+	a.p.mu.Unlock()
+	writeJSON(w, cfg)
+}
+
+func (a *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if a.p.configPath == "" {
+		http.Error(w, "no -config file in use, nothing to reload", http.StatusBadRequest)
+		return
+	}
+	a.p.reloadConfig()
+	writeJSON(w, map[string]bool{"reloaded": true})
+}
+
+func (a *adminServer) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	n, err := a.p.cache.flush()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+// handleCacheDelete deletes the ffprobe cache entry for the file path
+// given by {key}, URL-escaped, e.g. DELETE /cache/%2Fmedia%2Ffoo.mkv.
+func (a *adminServer) handleCacheDelete(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("key")
+	n, err := a.p.cache.deleteByPath(path, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"deleted": n})
+}
+
+// handleRescan invalidates every cached ffprobe entry under the subtree
+// named by the path query parameter, so the next browse re-probes them.
+func (a *adminServer) handleRescan(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSpace(r.URL.Query().Get("path"))
+	if path == "" {
+		http.Error(w, "missing path query parameter", http.StatusBadRequest)
+		return
+	}
+	n, err := a.p.cache.deleteByPath(path, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"invalidated": n})
+}
@@ -11,19 +11,19 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
-	"runtime"
+	"reflect"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/anacrolix/log"
 	"github.com/nfnt/resize"
 
 	"github.com/anacrolix/dms/dlna/dms"
-	"github.com/anacrolix/dms/rrcache"
 )
 
 //go:embed "data/VGC Sonic.png"
@@ -38,6 +38,7 @@ type dmsConfig struct {
 	DeviceIconSizes     []string
 	LogHeaders          bool
 	FFprobeCachePath    string
+	FFprobeCacheBackend string
 	NoTranscode         bool
 	ForceTranscodeTo    string
 	NoProbe             bool
@@ -49,6 +50,40 @@ type dmsConfig struct {
 	AllowedIpNets       []*net.IPNet
 	AllowDynamicStreams bool
 	TranscodeLogPattern string
+	Roots               []RootConfig
+	AdminHttp           string
+}
+
+// RootConfig describes one UPnP device to serve. When Roots is left empty
+// in dmsConfig, runErr synthesizes a single RootConfig from the top-level
+// Path/FriendlyName/Http/DeviceIcon/DeviceIconSizes/IgnorePaths/AllowedIpNets
+// flags, so a single-root setup behaves exactly as before multi-root
+// support was added.
+type RootConfig struct {
+	Path            string
+	FriendlyName    string
+	Http            string
+	DeviceIcon      string
+	DeviceIconSizes []string
+	IgnorePaths     []string
+	AllowedIpNets   []*net.IPNet
+}
+
+// rootsFromConfig returns the roots to serve: config.Roots verbatim if
+// set, otherwise a single root synthesized from the top-level fields.
+func rootsFromConfig() []RootConfig {
+	if len(config.Roots) > 0 {
+		return config.Roots
+	}
+	return []RootConfig{{
+		Path:            config.Path,
+		FriendlyName:    config.FriendlyName,
+		Http:            config.Http,
+		DeviceIcon:      config.DeviceIcon,
+		DeviceIconSizes: config.DeviceIconSizes,
+		IgnorePaths:     config.IgnorePaths,
+		AllowedIpNets:   config.AllowedIpNets,
+	}}
 }
 
 func (config *dmsConfig) load(configPath string) error {
@@ -68,18 +103,23 @@ func (config *dmsConfig) load(configPath string) error {
 
 // default config
 var config = &dmsConfig{
-	Path:             "",
-	IfName:           "",
-	Http:             ":1338",
-	FriendlyName:     "",
-	DeviceIcon:       "",
-	DeviceIconSizes:  []string{"48,128"},
-	LogHeaders:       false,
-	FFprobeCachePath: getDefaultFFprobeCachePath(),
-	ForceTranscodeTo: "",
-	NotifyInterval:   30 * time.Second,
+	Path:                "",
+	IfName:              "",
+	Http:                ":1338",
+	FriendlyName:        "",
+	DeviceIcon:          "",
+	DeviceIconSizes:     []string{"48,128"},
+	LogHeaders:          false,
+	FFprobeCachePath:    getDefaultFFprobeCachePath(),
+	FFprobeCacheBackend: "json",
+	ForceTranscodeTo:    "",
+	NotifyInterval:      30 * time.Second,
 }
 
+// ffprobeCacheCompactInterval is how often the ffprobe cache is scanned
+// for entries whose source file no longer exists.
+const ffprobeCacheCompactInterval = 30 * time.Minute
+
 func getDefaultFFprobeCachePath() (path string) {
 	_user, err := user.Current()
 	if err != nil {
@@ -90,36 +130,34 @@ func getDefaultFFprobeCachePath() (path string) {
 	return
 }
 
-type fFprobeCache struct {
-	c *rrcache.RRCache
-	sync.Mutex
-}
-
-func (fc *fFprobeCache) Get(key interface{}) (value interface{}, ok bool) {
-	fc.Lock()
-	defer fc.Unlock()
-	return fc.c.Get(key)
+func (p *program) run() {
+	err := p.runErr()
+	if err != nil {
+		log.Fatalf("error in runErr: %v", err)
+	}
 }
 
-func (fc *fFprobeCache) Set(key interface{}, value interface{}) {
-	fc.Lock()
-	defer fc.Unlock()
-	var size int64
-	for _, v := range []interface{}{key, value} {
-		b, err := json.Marshal(v)
-		if err != nil {
-			log.Printf("Could not marshal %v: %s", v, err)
-			continue
+// watchdogLoop sends periodic WATCHDOG=1 keepalives to systemd so the unit
+// can be configured with WatchdogSec. The cadence is tied to NotifyInterval
+// rather than WATCHDOG_USEC, matching the existing interface-polling loop.
+func (p *program) watchdogLoop() {
+	for {
+		time.Sleep(config.NotifyInterval)
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			p.logger.Print(err)
 		}
-		size += int64(len(b))
 	}
-	fc.c.Set(key, value, size)
 }
 
-func (p *program) run() {
-	err := p.runErr()
-	if err != nil {
-		log.Fatalf("error in runErr: %v", err)
+// compactCacheLoop periodically evicts ffprobe cache entries whose source
+// file no longer exists.
+func (p *program) compactCacheLoop() {
+	ticker := time.NewTicker(ffprobeCacheCompactInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.cache.compact(); err != nil {
+			p.logger.Print(err)
+		}
 	}
 }
 
@@ -132,10 +170,12 @@ func (p *program) runErr() error {
 	deviceIconSizes := flag.String("deviceIconSizes", strings.Join(config.DeviceIconSizes, ","), "comma separated list of icon sizes to advertise, eg 48,128,256. Use 48:512,128:512 format to force actual size.")
 	logHeaders := flag.Bool("logHeaders", config.LogHeaders, "log HTTP headers")
 	fFprobeCachePath := flag.String("fFprobeCachePath", config.FFprobeCachePath, "path to FFprobe cache file")
+	fFprobeCacheBackend := flag.String("fFprobeCacheBackend", config.FFprobeCacheBackend, "ffprobe cache backend, one of: json, bolt")
 	configFilePath := flag.String("config", "", "json configuration file")
 	allowedIps := flag.String("allowedIps", "", "allowed ip of clients, separated by comma")
 	forceTranscodeTo := flag.String("forceTranscodeTo", config.ForceTranscodeTo, "force transcoding to certain format, supported: 'chromecast', 'vp8', 'web'")
 	transcodeLogPattern := flag.String("transcodeLogPattern", "", "pattern where to write transcode logs to. The [tsname] placeholder is replaced with the name of the item currently being played. The default is $HOME/.dms/log/[tsname]")
+	adminHttp := flag.String("adminHttp", config.AdminHttp, "optional admin API listen address (e.g. 127.0.0.1:1339); disabled if empty. A bare port binds loopback only.")
 	flag.BoolVar(&config.NoTranscode, "noTranscode", false, "disable transcoding")
 	flag.BoolVar(&config.NoProbe, "noProbe", false, "disable media probing with ffprobe")
 	flag.BoolVar(&config.StallEventSubscribe, "stallEventSubscribe", false, "workaround for some bad event subscribers")
@@ -160,10 +200,12 @@ func (p *program) runErr() error {
 
 	config.LogHeaders = *logHeaders
 	config.FFprobeCachePath = *fFprobeCachePath
+	config.FFprobeCacheBackend = *fFprobeCacheBackend
 	config.AllowedIpNets = makeIpNets(*allowedIps)
 	config.ForceTranscodeTo = *forceTranscodeTo
 	config.IgnorePaths = strings.Split(*ignorePaths, ",")
 	config.TranscodeLogPattern = *transcodeLogPattern
+	config.AdminHttp = *adminHttp
 
 	if config.FriendlyName == "" {
 		config.FriendlyName = func() string {
@@ -187,102 +229,250 @@ func (p *program) runErr() error {
 	if len(*configFilePath) > 0 {
 		config.load(*configFilePath)
 	}
+	p.configPath = *configFilePath
+
+	p.roots = rootsFromConfig()
 
 	p.logger.Printf("device icon sizes are %q", config.DeviceIconSizes)
 	p.logger.Printf("allowed ip nets are %q", config.AllowedIpNets)
-	p.logger.Printf("serving folder %q", config.Path)
+	if len(p.roots) > 1 {
+		p.logger.Printf("serving %d roots", len(p.roots))
+	} else {
+		p.logger.Printf("serving folder %q", config.Path)
+	}
 	if config.AllowDynamicStreams {
 		p.logger.Printf("Dynamic streams ARE allowed")
 	}
 
-	p.cache = &fFprobeCache{
-		c: rrcache.New(64 << 20),
-	}
-	if err := p.cache.load(config.FFprobeCachePath); err != nil {
-		log.Print(err)
+	cache, err := newFFprobeCache(config.FFprobeCacheBackend, config.FFprobeCachePath)
+	if err != nil {
+		return fmt.Errorf("opening ffprobe cache: %w", err)
 	}
-	p.dmsServer = p.newDmsServer(getInterfaces(config.IfName))
-	if err := p.dmsServer.Init(); err != nil {
-		log.Fatalf("error initing dms server: %v", err)
+	p.cache = cache
+	go p.compactCacheLoop()
+
+	p.startedAt = time.Now()
+	if err := p.startAllRoots(getInterfaces(config.IfName)); err != nil {
+		return err
 	}
-	go func() {
-		if err := p.dmsServer.Run(); err != nil {
-			log.Fatal(err)
+
+	if config.AdminHttp != "" {
+		admin, err := newAdminServer(p, config.AdminHttp)
+		if err != nil {
+			return fmt.Errorf("starting admin API: %w", err)
 		}
-	}()
+		p.admin = admin
+		go p.admin.serve()
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		p.logger.Print(err)
+	}
+	if runningUnderSystemd() {
+		go p.watchdogLoop()
+	}
 	go func() {
 		for {
 			time.Sleep(config.NotifyInterval)
 			ifs := getInterfaces(config.IfName)
-			if len(p.dmsServer.Interfaces) < len(ifs) {
-				if err := p.dmsServer.Close(); err != nil {
-					log.Fatalf("error closing dms server: %v", err)
-				}
-				p.dmsServer = p.newDmsServer(ifs)
-				if err := p.dmsServer.Init(); err != nil {
-					log.Fatalf("error initing dms server: %v", err)
-				}
-				go func() {
-					if err := p.dmsServer.Run(); err != nil {
-						log.Fatal(err)
-					}
-				}()
+			p.mu.Lock()
+			if len(p.interfaces) < len(ifs) {
+				p.restartAllRoots(ifs)
 			}
+			p.mu.Unlock()
 		}
 	}()
+	go p.watchConfigLoop()
 
 	return nil
 }
 
-func (cache *fFprobeCache) load(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+// startAllRoots constructs, inits, and runs one dms.Server per p.roots,
+// all sharing the ffprobe cache and bound to ifs.
+func (p *program) startAllRoots(ifs []net.Interface) error {
+	p.dmsServers = make([]*dms.Server, len(p.roots))
+	for i, root := range p.roots {
+		srv := p.newDmsServer(i, root, ifs)
+		if err := srv.Init(); err != nil {
+			return fmt.Errorf("initing dms server for root %q: %w", root.Path, err)
+		}
+		p.dmsServers[i] = srv
+		go func() {
+			if err := srv.Run(); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
-	defer f.Close()
-	dec := json.NewDecoder(f)
-	var items []dms.FfprobeCacheItem
-	err = dec.Decode(&items)
-	if err != nil {
-		return err
+	p.interfaces = ifs
+	return nil
+}
+
+// restartRoot closes and replaces the i-th dms.Server, e.g. after a field
+// requiring a new listener has changed for that root.
+func (p *program) restartRoot(i int, ifs []net.Interface) {
+	if err := p.dmsServers[i].Close(); err != nil {
+		log.Fatalf("error closing dms server: %v", err)
 	}
-	for _, item := range items {
-		cache.Set(item.Key, item.Value)
+	srv := p.newDmsServer(i, p.roots[i], ifs)
+	if err := srv.Init(); err != nil {
+		log.Fatalf("error initing dms server: %v", err)
 	}
-	log.Printf("added %d items from cache", len(items))
-	return nil
+	p.dmsServers[i] = srv
+	go func() {
+		if err := srv.Run(); err != nil {
+			log.Fatal(err)
+		}
+	}()
 }
 
-func (cache *fFprobeCache) save(path string) error {
-	cache.Lock()
-	items := cache.c.Items()
-	cache.Unlock()
-	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
-	if err != nil {
-		return err
+// restartAllRoots restarts every dms.Server bound to ifs, e.g. after the
+// set of usable network interfaces has changed. It assumes
+// len(p.dmsServers) == len(p.roots); use rebuildAllRoots instead when the
+// root count itself just changed.
+func (p *program) restartAllRoots(ifs []net.Interface) {
+	for i := range p.roots {
+		p.restartRoot(i, ifs)
 	}
-	enc := json.NewEncoder(f)
-	err = enc.Encode(items)
-	f.Close()
+	p.interfaces = ifs
+}
+
+// rebuildAllRoots closes every existing dms.Server and reconstructs
+// p.dmsServers from scratch, sized to the current p.roots. Unlike
+// restartAllRoots/restartRoot, it doesn't assume the old and new root
+// counts match, so it's the one safe to call right after p.roots has
+// grown or shrunk.
+func (p *program) rebuildAllRoots(ifs []net.Interface) {
+	for _, srv := range p.dmsServers {
+		if err := srv.Close(); err != nil {
+			log.Fatalf("error closing dms server: %v", err)
+		}
+	}
+	if err := p.startAllRoots(ifs); err != nil {
+		log.Fatalf("error starting dms servers: %v", err)
+	}
+}
+
+// watchConfigLoop reloads the config file named by -config on SIGHUP or
+// when its mtime advances. It is a no-op when no -config file is in use.
+func (p *program) watchConfigLoop() {
+	if p.configPath == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	lastMod := configModTime(p.configPath)
+
+	ticker := time.NewTicker(config.NotifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			p.logger.Println("reload: SIGHUP received")
+			p.reloadConfig()
+			lastMod = configModTime(p.configPath)
+		case <-ticker.C:
+			if mod := configModTime(p.configPath); mod.After(lastMod) {
+				p.logger.Println("reload: config file changed on disk")
+				p.reloadConfig()
+				lastMod = mod
+			}
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	fi, err := os.Stat(path)
 	if err != nil {
-		os.Remove(f.Name())
-		return err
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// reloadConfig re-reads the config file named by p.configPath and applies
+// any changes under p.mu. Every dms.Server field is always set at
+// construction time rather than mutated on a live server: the vendored
+// dms.Server reads its fields directly from in-flight request handler
+// goroutines with no locking of its own, so a server-wide field change
+// (IgnoreHidden, IgnoreUnreadable, LogHeaders, NoTranscode,
+// ForceTranscodeTo, TranscodeLogPattern), a changed IfName, or a changed
+// root count restarts every root, and a change scoped to one root (Path,
+// Http, FriendlyName, device icon, AllowedIpNets, IgnorePaths) restarts
+// just that root. None of this drops the ffprobe cache.
+func (p *program) reloadConfig() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := *config
+	if err := config.load(p.configPath); err != nil {
+		p.logger.Print(err)
+		return
 	}
-	if runtime.GOOS == "windows" {
-		err = os.Remove(path)
-		if err == os.ErrNotExist {
-			err = nil
+
+	var changed []string
+	globalChanged := false
+
+	noteGlobal := func(field string, same bool) {
+		if !same {
+			changed = append(changed, field)
+			globalChanged = true
 		}
 	}
-	if err == nil {
-		err = os.Rename(f.Name(), path)
+	noteGlobal("IgnoreHidden", old.IgnoreHidden == config.IgnoreHidden)
+	noteGlobal("IgnoreUnreadable", old.IgnoreUnreadable == config.IgnoreUnreadable)
+	noteGlobal("LogHeaders", old.LogHeaders == config.LogHeaders)
+	noteGlobal("NoTranscode", old.NoTranscode == config.NoTranscode)
+	noteGlobal("ForceTranscodeTo", old.ForceTranscodeTo == config.ForceTranscodeTo)
+	noteGlobal("TranscodeLogPattern", old.TranscodeLogPattern == config.TranscodeLogPattern)
+
+	newRoots := rootsFromConfig()
+	rootCountChanged := len(newRoots) != len(p.roots)
+	ifNameChanged := old.IfName != config.IfName
+	if ifNameChanged {
+		changed = append(changed, "IfName")
 	}
-	if err == nil {
-		log.Printf("saved cache with %d items", len(items))
-	} else {
-		os.Remove(f.Name())
+
+	if rootCountChanged {
+		changed = append(changed, "Roots")
+		p.logger.Printf("reload: changed fields: %s", strings.Join(changed, ", "))
+		p.logger.Println("reload: root count changed, rebuilding all dms servers")
+		p.roots = newRoots
+		p.rebuildAllRoots(getInterfaces(config.IfName))
+		return
+	}
+
+	if globalChanged || ifNameChanged {
+		p.logger.Printf("reload: changed fields: %s", strings.Join(changed, ", "))
+		p.logger.Println("reload: restarting all dms servers")
+		p.roots = newRoots
+		p.restartAllRoots(getInterfaces(config.IfName))
+		return
+	}
+
+	restartIdx := make(map[int]bool)
+	for i, newRoot := range newRoots {
+		if !reflect.DeepEqual(p.roots[i], newRoot) {
+			changed = append(changed, fmt.Sprintf("Roots[%d]", i))
+			restartIdx[i] = true
+		}
+	}
+	p.roots = newRoots
+
+	if len(changed) == 0 {
+		p.logger.Println("reload: config unchanged")
+		return
+	}
+	p.logger.Printf("reload: changed fields: %s", strings.Join(changed, ", "))
+
+	if len(restartIdx) > 0 {
+		ifs := getInterfaces(config.IfName)
+		for i := range restartIdx {
+			p.restartRoot(i, ifs)
+		}
+		p.interfaces = ifs
 	}
-	return err
 }
 
 func getIconReader(path string) (io.ReadCloser, error) {
@@ -344,19 +534,26 @@ func makeIpNets(s string) []*net.IPNet {
 	return nets
 }
 
-func (p *program) newDmsServer(ifs []net.Interface) *dms.Server {
+// newDmsServer builds the dms.Server for root, the i-th entry of p.roots.
+// i also selects which systemd socket-activated listener (if any) this
+// root's HTTPConn inherits, so a unit with one Sockets= line per root maps
+// listeners to roots in order.
+func (p *program) newDmsServer(i int, root RootConfig, ifs []net.Interface) *dms.Server {
 	return &dms.Server{
-		Logger:     p.logger.WithNames("dms", "server"),
+		Logger:     p.logger.WithNames("dms", "server", root.FriendlyName),
 		Interfaces: ifs,
 		HTTPConn: func() net.Listener {
-			conn, err := net.Listen("tcp", config.Http)
+			if l, ok := systemdListener(i); ok {
+				return l
+			}
+			conn, err := net.Listen("tcp", root.Http)
 			if err != nil {
 				log.Fatal(err)
 			}
 			return conn
 		}(),
-		FriendlyName:        config.FriendlyName,
-		RootObjectPath:      filepath.Clean(config.Path),
+		FriendlyName:        root.FriendlyName,
+		RootObjectPath:      filepath.Clean(root.Path),
 		FFProbeCache:        p.cache,
 		LogHeaders:          config.LogHeaders,
 		NoTranscode:         config.NoTranscode,
@@ -366,7 +563,7 @@ func (p *program) newDmsServer(ifs []net.Interface) *dms.Server {
 		NoProbe:             config.NoProbe,
 		Icons: func() []dms.Icon {
 			var icons []dms.Icon
-			for _, size := range config.DeviceIconSizes {
+			for _, size := range root.DeviceIconSizes {
 				s := strings.Split(size, ":")
 				if len(s) != 1 && len(s) != 2 {
 					log.Fatal("bad device icon size: ", size)
@@ -388,7 +585,7 @@ func (p *program) newDmsServer(ifs []net.Interface) *dms.Server {
 					Height:   advertisedSize,
 					Depth:    8,
 					Mimetype: "image/png",
-					Bytes:    readIcon(config.DeviceIcon, uint(actualSize)),
+					Bytes:    readIcon(root.DeviceIcon, uint(actualSize)),
 				})
 			}
 			return icons
@@ -397,8 +594,8 @@ func (p *program) newDmsServer(ifs []net.Interface) *dms.Server {
 		NotifyInterval:      config.NotifyInterval,
 		IgnoreHidden:        config.IgnoreHidden,
 		IgnoreUnreadable:    config.IgnoreUnreadable,
-		IgnorePaths:         config.IgnorePaths,
-		AllowedIpNets:       config.AllowedIpNets,
+		IgnorePaths:         root.IgnorePaths,
+		AllowedIpNets:       root.AllowedIpNets,
 	}
 }
 
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+	"github.com/anacrolix/log"
+	"go.etcd.io/bbolt"
+
+	"github.com/anacrolix/dms/rrcache"
+)
+
+// fFprobeCacheMemCapacity bounds the in-memory RRCache tier, in bytes.
+const fFprobeCacheMemCapacity = 64 << 20
+
+// fFprobeCache is the dms.Cache implementation passed to dms.Server. It
+// keeps hot entries in an in-memory RRCache and falls back to a pluggable
+// on-disk backend on miss.
+type fFprobeCache struct {
+	mem          *rrcache.RRCache
+	backend      fFprobeCacheBackend
+	hits, misses int64
+	sync.Mutex
+}
+
+// cacheStats summarizes the on-disk backend and the in-memory hit rate,
+// for reporting over the admin API.
+type cacheStats struct {
+	Entries   int
+	SizeBytes int64
+	Hits      int64
+	Misses    int64
+}
+
+// cacheEntry is what backends persist for each probed file: the ffprobe
+// result itself, plus bookkeeping used by compaction and, eventually,
+// eviction.
+type cacheEntry struct {
+	Value      *ffprobe.Info
+	Size       int64
+	AccessedAt time.Time
+}
+
+// ffprobeCacheKey mirrors the on-disk shape of anacrolix/dms's unexported
+// ffmpegInfoCacheKey (Path, ModTime), letting backends recover the source
+// path from a marshalled cache key without depending on that type.
+type ffprobeCacheKey struct {
+	Path    string
+	ModTime int64
+}
+
+// fFprobeCacheBackend is the disk tier behind fFprobeCache. rawKey is
+// always the JSON encoding of the probe key, which doubles as a stable,
+// comparable identifier for the backend to store entries under.
+type fFprobeCacheBackend interface {
+	get(rawKey []byte) (entry cacheEntry, ok bool, err error)
+	set(rawKey []byte, entry cacheEntry) error
+	// compact evicts entries whose source file no longer exists.
+	compact() error
+	// stats reports the number of entries and their total recorded size.
+	stats() (count int, size int64, err error)
+	// flush deletes every entry, returning the number removed.
+	flush() (int, error)
+	// deleteByPath deletes entries whose decoded key's Path either equals
+	// path (prefix false) or has path as a directory prefix (prefix true).
+	// It returns the number of entries removed.
+	deleteByPath(path string, prefix bool) (int, error)
+	close() error
+}
+
+// newFFprobeCache opens the on-disk backend named by backendName at path
+// and wraps it with an in-memory RRCache tier.
+func newFFprobeCache(backendName, path string) (*fFprobeCache, error) {
+	var backend fFprobeCacheBackend
+	switch backendName {
+	case "", "json":
+		b := newJSONCacheBackend(path)
+		if err := b.load(); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		backend = b
+	case "bolt":
+		b, err := newBoltCacheBackend(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening bolt ffprobe cache: %w", err)
+		}
+		backend = b
+	default:
+		return nil, fmt.Errorf("unknown ffprobe cache backend %q", backendName)
+	}
+
+	return &fFprobeCache{
+		mem:     rrcache.New(fFprobeCacheMemCapacity),
+		backend: backend,
+	}, nil
+}
+
+func (fc *fFprobeCache) Get(key interface{}) (value interface{}, ok bool) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if value, ok = fc.mem.Get(key); ok {
+		fc.hits++
+		return value, true
+	}
+
+	rawKey, err := json.Marshal(key)
+	if err != nil {
+		log.Printf("could not marshal ffprobe cache key %v: %s", key, err)
+		fc.misses++
+		return nil, false
+	}
+	entry, ok, err := fc.backend.get(rawKey)
+	if err != nil {
+		log.Printf("ffprobe cache backend get error: %s", err)
+		fc.misses++
+		return nil, false
+	}
+	if !ok {
+		fc.misses++
+		return nil, false
+	}
+
+	entry.AccessedAt = time.Now()
+	if err := fc.backend.set(rawKey, entry); err != nil {
+		log.Printf("ffprobe cache backend set error: %s", err)
+	}
+
+	fc.mem.Set(key, entry.Value, entry.Size)
+	fc.hits++
+	return entry.Value, true
+}
+
+func (fc *fFprobeCache) Set(key interface{}, value interface{}) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	var size int64
+	for _, v := range []interface{}{key, value} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.Printf("Could not marshal %v: %s", v, err)
+			continue
+		}
+		size += int64(len(b))
+	}
+	fc.mem.Set(key, value, size)
+
+	rawKey, err := json.Marshal(key)
+	if err != nil {
+		log.Printf("could not marshal ffprobe cache key %v: %s", key, err)
+		return
+	}
+	info, _ := value.(*ffprobe.Info)
+	entry := cacheEntry{Value: info, Size: size, AccessedAt: time.Now()}
+	if err := fc.backend.set(rawKey, entry); err != nil {
+		log.Printf("ffprobe cache backend set error: %s", err)
+	}
+}
+
+// compact asks the backend to evict entries whose source file is gone.
+func (fc *fFprobeCache) compact() error {
+	return fc.backend.compact()
+}
+
+// stats reports the on-disk entry count and size alongside the in-memory
+// tier's cumulative hit/miss counts.
+func (fc *fFprobeCache) stats() (cacheStats, error) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	count, size, err := fc.backend.stats()
+	if err != nil {
+		return cacheStats{}, err
+	}
+	return cacheStats{Entries: count, SizeBytes: size, Hits: fc.hits, Misses: fc.misses}, nil
+}
+
+// flush deletes every backend entry and drops the in-memory tier, since
+// rrcache offers no way to selectively evict the keys it just lost.
+func (fc *fFprobeCache) flush() (int, error) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	n, err := fc.backend.flush()
+	fc.mem = rrcache.New(fFprobeCacheMemCapacity)
+	return n, err
+}
+
+// deleteByPath deletes backend entries for path (or, if prefix is true,
+// every entry under path), dropping the in-memory tier for the same
+// reason flush does.
+func (fc *fFprobeCache) deleteByPath(path string, prefix bool) (int, error) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	n, err := fc.backend.deleteByPath(path, prefix)
+	fc.mem = rrcache.New(fFprobeCacheMemCapacity)
+	return n, err
+}
+
+func (fc *fFprobeCache) close() error {
+	return fc.backend.close()
+}
+
+// jsonCacheBackend is the default, compatibility backend: it keeps every
+// entry in memory and rewrites the whole file on close, exactly as the
+// previous fFprobeCache.load/save did.
+type jsonCacheBackend struct {
+	path string
+	mu   sync.Mutex
+	// items is keyed by string(rawKey), the JSON-encoded probe key.
+	items map[string]cacheEntry
+}
+
+// jsonCacheRecord is the on-disk shape of one entry. Key is kept as a raw
+// message so it round-trips byte-for-byte through string(rawKey).
+type jsonCacheRecord struct {
+	Key        json.RawMessage
+	Value      *ffprobe.Info
+	Size       int64
+	AccessedAt time.Time
+}
+
+func newJSONCacheBackend(path string) *jsonCacheBackend {
+	return &jsonCacheBackend{
+		path:  path,
+		items: make(map[string]cacheEntry),
+	}
+}
+
+func (b *jsonCacheBackend) load() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	var records []jsonCacheRecord
+	if err := dec.Decode(&records); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	for _, rec := range records {
+		b.items[string(rec.Key)] = cacheEntry{Value: rec.Value, Size: rec.Size, AccessedAt: rec.AccessedAt}
+	}
+	b.mu.Unlock()
+
+	log.Printf("added %d items from cache", len(records))
+	return nil
+}
+
+func (b *jsonCacheBackend) get(rawKey []byte) (cacheEntry, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.items[string(rawKey)]
+	return entry, ok, nil
+}
+
+func (b *jsonCacheBackend) set(rawKey []byte, entry cacheEntry) error {
+	b.mu.Lock()
+	b.items[string(rawKey)] = entry
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *jsonCacheBackend) compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	evicted := 0
+	for rawKey := range b.items {
+		var key ffprobeCacheKey
+		if err := json.Unmarshal([]byte(rawKey), &key); err != nil {
+			continue
+		}
+		if _, err := os.Stat(key.Path); err != nil {
+			delete(b.items, rawKey)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		log.Printf("compacted ffprobe cache, evicted %d stale entries", evicted)
+	}
+	return nil
+}
+
+func (b *jsonCacheBackend) stats() (count int, size int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, entry := range b.items {
+		size += entry.Size
+	}
+	return len(b.items), size, nil
+}
+
+func (b *jsonCacheBackend) flush() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.items)
+	b.items = make(map[string]cacheEntry)
+	return n, nil
+}
+
+func (b *jsonCacheBackend) deleteByPath(path string, prefix bool) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for rawKey := range b.items {
+		var key ffprobeCacheKey
+		if err := json.Unmarshal([]byte(rawKey), &key); err != nil {
+			continue
+		}
+		if matchesPath(key.Path, path, prefix) {
+			delete(b.items, rawKey)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// close writes the whole cache out in one go, same as the legacy save().
+func (b *jsonCacheBackend) close() error {
+	b.mu.Lock()
+	records := make([]jsonCacheRecord, 0, len(b.items))
+	for rawKey, entry := range b.items {
+		records = append(records, jsonCacheRecord{
+			Key:        json.RawMessage(rawKey),
+			Value:      entry.Value,
+			Size:       entry.Size,
+			AccessedAt: entry.AccessedAt,
+		})
+	}
+	b.mu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	err = enc.Encode(records)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		err = os.Remove(b.path)
+		if err == os.ErrNotExist {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), b.path)
+	}
+	if err == nil {
+		log.Printf("saved cache with %d items", len(records))
+	} else {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// matchesPath reports whether entryPath is the path being invalidated: an
+// exact match, or, when prefix is set, a descendant of it.
+func matchesPath(entryPath, path string, prefix bool) bool {
+	if !prefix {
+		return entryPath == path
+	}
+	return entryPath == path || strings.HasPrefix(entryPath, strings.TrimSuffix(path, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// boltCacheBackend writes each Set through to a bbolt file as it happens,
+// keyed by the marshalled probe key, and treats that file as the source
+// of truth: Get lazily consults it on an in-memory miss rather than
+// bulk-loading everything at startup.
+type boltCacheBackend struct {
+	db *bbolt.DB
+}
+
+var ffprobeCacheBucket = []byte("ffprobe")
+
+func newBoltCacheBackend(path string) (*boltCacheBackend, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ffprobeCacheBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltCacheBackend{db: db}, nil
+}
+
+func (b *boltCacheBackend) get(rawKey []byte) (entry cacheEntry, ok bool, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(ffprobeCacheBucket).Get(rawKey)
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &entry)
+	})
+	return entry, ok, err
+}
+
+func (b *boltCacheBackend) set(rawKey []byte, entry cacheEntry) error {
+	rawValue, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(ffprobeCacheBucket).Put(rawKey, rawValue)
+	})
+}
+
+func (b *boltCacheBackend) compact() error {
+	var stale [][]byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(ffprobeCacheBucket).ForEach(func(k, v []byte) error {
+			var key ffprobeCacheKey
+			if err := json.Unmarshal(k, &key); err != nil {
+				return nil
+			}
+			if _, err := os.Stat(key.Path); err != nil {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(ffprobeCacheBucket)
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		log.Printf("compacted ffprobe cache, evicted %d stale entries", len(stale))
+	}
+	return err
+}
+
+func (b *boltCacheBackend) stats() (count int, size int64, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(ffprobeCacheBucket).ForEach(func(k, v []byte) error {
+			var entry cacheEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return nil
+			}
+			count++
+			size += entry.Size
+			return nil
+		})
+	})
+	return count, size, err
+}
+
+func (b *boltCacheBackend) flush() (int, error) {
+	n, _, err := b.stats()
+	if err != nil {
+		return 0, err
+	}
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(ffprobeCacheBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(ffprobeCacheBucket)
+		return err
+	})
+	return n, err
+}
+
+func (b *boltCacheBackend) deleteByPath(path string, prefix bool) (int, error) {
+	var matched [][]byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(ffprobeCacheBucket).ForEach(func(k, v []byte) error {
+			var key ffprobeCacheKey
+			if err := json.Unmarshal(k, &key); err != nil {
+				return nil
+			}
+			if matchesPath(key.Path, path, prefix) {
+				matched = append(matched, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(matched) == 0 {
+		return 0, err
+	}
+
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(ffprobeCacheBucket)
+		for _, k := range matched {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(matched), nil
+}
+
+func (b *boltCacheBackend) close() error {
+	return b.db.Close()
+}
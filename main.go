@@ -1,9 +1,11 @@
 package main
 
 import (
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/anacrolix/dms/dlna/dms"
 	"github.com/anacrolix/log"
@@ -11,11 +13,21 @@ import (
 )
 
 type program struct {
-	dmsServer *dms.Server
-	cache     *fFprobeCache
-	logger    log.Logger
-	wg        sync.WaitGroup
-	quit      chan struct{}
+	// mu guards roots, dmsServers, and interfaces, which are read from
+	// admin API handlers and the interface-poll loop, and written from
+	// restartRoot/restartAllRoots/reloadConfig, all on their own
+	// goroutines.
+	mu         sync.Mutex
+	roots      []RootConfig
+	dmsServers []*dms.Server
+	interfaces []net.Interface
+	cache      *fFprobeCache
+	admin      *adminServer
+	startedAt  time.Time
+	logger     log.Logger
+	wg         sync.WaitGroup
+	quit       chan struct{}
+	configPath string
 }
 
 func main() {
@@ -47,6 +59,8 @@ func (p *program) Init(env svc.Environment) error {
 		if err := config.load(filepath.Join(dir, "dmssvc.json")); err != nil {
 			p.logger.Print(err)
 		}
+	} else if runningUnderSystemd() {
+		p.logger.Println("running under systemd, logging to stderr for journald")
 	}
 
 	return nil
@@ -69,11 +83,23 @@ func (p *program) Start() error {
 
 func (p *program) Stop() error {
 	p.logger.Println("Stopping...")
-	err := p.dmsServer.Close()
-	if err != nil {
-		log.Fatal(err)
+	if err := sdNotify("STOPPING=1"); err != nil {
+		p.logger.Print(err)
+	}
+	if p.admin != nil {
+		if err := p.admin.close(); err != nil {
+			p.logger.Print(err)
+		}
+	}
+	p.mu.Lock()
+	servers := p.dmsServers
+	p.mu.Unlock()
+	for _, srv := range servers {
+		if err := srv.Close(); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if err := p.cache.save(config.FFprobeCachePath); err != nil {
+	if err := p.cache.close(); err != nil {
 		p.logger.Print(err)
 	}
 	close(p.quit)
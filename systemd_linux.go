@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/anacrolix/log"
+)
+
+// listenFdsStart is the file descriptor systemd starts passing inherited
+// sockets at, per sd_listen_fds(3).
+const listenFdsStart = 3
+
+// runningUnderSystemd reports whether the process appears to have been
+// started by systemd, either via socket activation or with notify
+// supervision enabled.
+func runningUnderSystemd() bool {
+	return os.Getenv("NOTIFY_SOCKET") != "" || os.Getenv("LISTEN_FDS") != ""
+}
+
+// systemdFiles caches the *os.File wrapping each socket-activated fd,
+// keyed by index, the first time it's looked up. A root's dms.Server gets
+// closed (and with it, its net.Listener) on every restart, but systemd
+// only ever hands each fd to the process once: if we instead handed out
+// the fd itself and let it get closed along with the listener, the next
+// restart would find that fd number already closed. Keeping the *os.File
+// open for the life of the process lets net.FileListener dup a fresh,
+// independently closeable listener from it on every call.
+var (
+	systemdFilesMu sync.Mutex
+	systemdFiles   = make(map[int]*os.File)
+)
+
+// systemdListener returns the index-th socket-activated listener passed
+// down by systemd, if any, e.g. one Sockets= line per root in the unit
+// file. It mirrors the minimal subset of sd_listen_fds(3) needed here
+// rather than pulling in a dependency for it.
+func systemdListener(index int) (net.Listener, bool) {
+	systemdFilesMu.Lock()
+	f, cached := systemdFiles[index]
+	systemdFilesMu.Unlock()
+
+	if !cached {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return nil, false
+		}
+
+		nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || index >= nfds {
+			return nil, false
+		}
+
+		f = os.NewFile(uintptr(listenFdsStart+index), "systemd-socket")
+
+		systemdFilesMu.Lock()
+		systemdFiles[index] = f
+		systemdFilesMu.Unlock()
+	}
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		log.Print(err)
+		return nil, false
+	}
+
+	return l, true
+}
+
+// sdNotify sends a message to the systemd notify socket named by
+// NOTIFY_SOCKET, e.g. "READY=1" or "WATCHDOG=1". It is a no-op when the
+// process isn't running under systemd notify supervision.
+func sdNotify(state string) error {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return nil
+	}
+
+	addr := &net.UnixAddr{Name: socketName, Net: "unixgram"}
+	conn, err := net.DialUnix(addr.Net, nil, addr)
+	if err != nil {
+		return fmt.Errorf("dialing systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("writing to systemd notify socket: %w", err)
+	}
+
+	return nil
+}
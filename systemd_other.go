@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// runningUnderSystemd always reports false on non-Linux platforms.
+func runningUnderSystemd() bool {
+	return false
+}
+
+// systemdListener never has a socket-activated listener to offer outside
+// of Linux.
+func systemdListener(index int) (net.Listener, bool) {
+	return nil, false
+}
+
+// sdNotify is a no-op outside of Linux.
+func sdNotify(state string) error {
+	return nil
+}